@@ -7,10 +7,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -68,6 +70,29 @@ func WithDebug(d bool) ClientOption {
 	}
 }
 
+// WithSenderPoolSize caps the number of target addresses the client
+// keeps a live AMQP sender link open for; once the cap is reached, the
+// least recently used link is closed to make room for a new one. Zero,
+// the default, means unbounded.
+func WithSenderPoolSize(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.New("sender pool size must not be negative")
+		}
+		c.senderPoolSize = n
+		return nil
+	}
+}
+
+// WithSenderIdleTimeout closes pooled sender links that haven't been
+// used for at least d. Zero, the default, disables idle reaping.
+func WithSenderIdleTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		c.senderIdleTimeout = d
+		return nil
+	}
+}
+
 // NewClient creates new iothub service client.
 func NewClient(opts ...ClientOption) (*Client, error) {
 	c := &Client{
@@ -106,6 +131,13 @@ type Client struct {
 	logger *log.Logger
 	debug  bool
 	http   *http.Client // REST client
+
+	senders           map[string]*senderLink
+	senderPoolSize    int
+	senderIdleTimeout time.Duration
+
+	sas          string
+	sasRefreshAt time.Time
 }
 
 // Connect connects to AMQP broker, has to be done before publishing events.
@@ -134,6 +166,10 @@ func (c *Client) Connect(ctx context.Context) error {
 		return err
 	}
 	c.conn = eh
+
+	if c.senderIdleTimeout > 0 {
+		go c.reapIdleSenders(c.senderIdleTimeout)
+	}
 	return nil
 }
 
@@ -341,22 +377,246 @@ func (c *Client) SendEvent(
 			return err
 		}
 	}
+	return c.sendOnPooledLink(ctx, msg)
+}
 
-	// opening a new link for every message is not the most efficient way
-	send, err := c.conn.Sess().NewSender(
-		amqp.LinkTargetAddress("/messages/devicebound"),
-	)
+// senderTargetDeviceBound is the AMQP target address every cloud-to-device
+// message is sent on, regardless of which device it's addressed to.
+const senderTargetDeviceBound = "/messages/devicebound"
+
+// senderLink is a pooled AMQP sender, keyed by target address in
+// Client.senders.
+type senderLink struct {
+	sender   *amqp.Sender
+	lastUsed time.Time
+}
+
+// oldestSenderAddr returns the address of the least-recently-used entry
+// in senders, or "" if senders is empty.
+func oldestSenderAddr(senders map[string]*senderLink) string {
+	var oldestAddr string
+	var oldest time.Time
+	for addr, l := range senders {
+		if oldestAddr == "" || l.lastUsed.Before(oldest) {
+			oldestAddr, oldest = addr, l.lastUsed
+		}
+	}
+	return oldestAddr
+}
+
+// senderFor returns a live sender link for address, reusing a pooled one
+// when available and lazily creating it otherwise.
+func (c *Client) senderFor(address string) (*amqp.Sender, error) {
+	c.mu.Lock()
+	if l, ok := c.senders[address]; ok {
+		l.lastUsed = time.Now()
+		c.mu.Unlock()
+		return l.sender, nil
+	}
+	c.mu.Unlock()
+
+	// Opening a link is a network round-trip, do it without holding the
+	// lock so concurrent callers hitting an already-pooled link (or a
+	// different address) aren't serialized behind it.
+	send, err := c.conn.Sess().NewSender(amqp.LinkTargetAddress(address))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if l, ok := c.senders[address]; ok {
+		// Lost the race to another goroutine, use its link instead.
+		c.mu.Unlock()
+		send.Close()
+		return l.sender, nil
+	}
+
+	if c.senders == nil {
+		c.senders = make(map[string]*senderLink)
+	}
+	var evict *senderLink
+	if c.senderPoolSize > 0 && len(c.senders) >= c.senderPoolSize {
+		oldestAddr := oldestSenderAddr(c.senders)
+		evict = c.senders[oldestAddr]
+		delete(c.senders, oldestAddr)
+	}
+	c.senders[address] = &senderLink{sender: send, lastUsed: time.Now()}
+	c.mu.Unlock()
+
+	if evict != nil {
+		evict.sender.Close()
+	}
+	return send, nil
+}
+
+// evictSender drops address's pooled link, if any, so the next send
+// recreates it.
+func (c *Client) evictSender(address string) {
+	c.mu.Lock()
+	l, ok := c.senders[address]
+	if ok {
+		delete(c.senders, address)
+	}
+	c.mu.Unlock()
+	if ok {
+		l.sender.Close()
+	}
+}
+
+// reapIdleSenders periodically closes pooled links that have been idle
+// for at least ttl, until the client is closed.
+func (c *Client) reapIdleSenders(ttl time.Duration) {
+	t := time.NewTicker(ttl)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			c.mu.Lock()
+			var expired []*senderLink
+			for addr, l := range c.senders {
+				if time.Since(l.lastUsed) >= ttl {
+					expired = append(expired, l)
+					delete(c.senders, addr)
+				}
+			}
+			c.mu.Unlock()
+
+			for _, l := range expired {
+				l.sender.Close()
+			}
+		}
+	}
+}
+
+// sendOnPooledLink sends msg on the pooled devicebound link, transparently
+// recreating it once if the broker detached it.
+func (c *Client) sendOnPooledLink(ctx context.Context, msg *common.Message) error {
+	send, err := c.senderFor(senderTargetDeviceBound)
 	if err != nil {
 		return err
 	}
-	defer send.Close()
-	return send.Send(ctx, commonamqp.ToAMQPMessage(msg))
+
+	amqpMsg := commonamqp.ToAMQPMessage(msg)
+	if err := send.Send(ctx, amqpMsg); err != nil {
+		if _, ok := err.(amqp.DetachError); !ok {
+			return err
+		}
+		c.evictSender(senderTargetDeviceBound)
+
+		send, err = c.senderFor(senderTargetDeviceBound)
+		if err != nil {
+			return err
+		}
+		return send.Send(ctx, amqpMsg)
+	}
+	return nil
+}
+
+// Outgoing is a single cloud-to-device message to send as part of a
+// SendEventBatch or SendAsync call.
+type Outgoing struct {
+	DeviceID string
+	Payload  []byte
+	Opts     []SendOption
+}
+
+// SendEventBatch sends every message in msgs on the pooled devicebound
+// link, reusing that one link for the whole batch. Messages are sent one
+// at a time, in order: a send starts only after the previous one has
+// returned, so sends are not pipelined. It returns one error per message,
+// in the same order as msgs (nil on success), so a single bad message
+// doesn't abort the rest of the batch.
+func (c *Client) SendEventBatch(ctx context.Context, msgs []Outgoing) ([]error, error) {
+	if !c.isConnected() {
+		return nil, errNotConnected
+	}
+
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		if m.DeviceID == "" {
+			errs[i] = errors.New("device id is empty")
+			continue
+		}
+		if m.Payload == nil {
+			errs[i] = errors.New("payload is nil")
+			continue
+		}
+
+		msg := &common.Message{
+			Payload: m.Payload,
+			To:      "/devices/" + m.DeviceID + "/messages/devicebound",
+		}
+		for _, opt := range m.Opts {
+			if err := opt(msg); err != nil {
+				errs[i] = err
+				break
+			}
+		}
+		if errs[i] != nil {
+			continue
+		}
+		errs[i] = c.sendOnPooledLink(ctx, msg)
+	}
+	return errs, nil
+}
+
+// SendAsync sends a single cloud-to-device message without blocking the
+// caller and returns a channel carrying the send result, letting many
+// goroutines drive high throughput through the same pooled link without
+// each one paying a link-open round-trip.
+func (c *Client) SendAsync(ctx context.Context, deviceID string, payload []byte, opts ...SendOption) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- c.SendEvent(ctx, deviceID, payload, opts...)
+	}()
+	return ch
+}
+
+// Disposition tells the broker how to settle a message received from a
+// service-bound link, such as the feedback or file-notification queues.
+type Disposition int
+
+const (
+	// Accept completes the message, removing it from the queue.
+	Accept Disposition = iota
+	// Abandon releases the message back onto the queue for redelivery.
+	Abandon
+	// Reject dead-letters the message.
+	Reject
+)
+
+// settler is the subset of *amqp.Message's disposition methods that
+// applyDisposition needs; *amqp.Message satisfies it, as do test fakes.
+type settler interface {
+	Accept()
+	Release()
+	Reject()
+}
+
+// applyDisposition settles msg according to d, defaulting unknown values
+// to Accept so a zero-value Disposition never stalls the queue.
+func applyDisposition(msg settler, d Disposition) {
+	switch d {
+	case Abandon:
+		msg.Release()
+	case Reject:
+		msg.Reject()
+	default:
+		msg.Accept()
+	}
 }
 
-// FeedbackFunc handles message feedback.
-type FeedbackFunc func(f *Feedback)
+// FeedbackFunc handles a batch of message feedback delivered in a single
+// AMQP message and returns how that message should be settled.
+type FeedbackFunc func(f []*Feedback) Disposition
 
-// SubscribeFeedback subscribes to feedback of messages that ack was requested.
+// SubscribeFeedback subscribes to feedback of messages that ack was
+// requested for. fn's return value is applied to the underlying AMQP
+// message, so feedback the application couldn't process can be abandoned
+// for redelivery or rejected to the dead-letter queue instead of always
+// being silently accepted.
 func (c *Client) SubscribeFeedback(ctx context.Context, fn FeedbackFunc) error {
 	if !c.isConnected() {
 		return errNotConnected
@@ -374,15 +634,13 @@ func (c *Client) SubscribeFeedback(ctx context.Context, fn FeedbackFunc) error {
 		if err != nil {
 			return err
 		}
-		msg.Accept()
 
 		var v []*Feedback
-		if err = json.Unmarshal(msg.Data[0], &v); err != nil {
+		if err := json.Unmarshal(msg.Data[0], &v); err != nil {
+			msg.Reject()
 			return err
 		}
-		for _, f := range v {
-			go fn(f)
-		}
+		applyDisposition(msg, fn(v))
 	}
 }
 
@@ -396,7 +654,77 @@ type Feedback struct {
 	StatusCode         string    `json:"statusCode"`
 }
 
-type call struct {
+// FileUploadNotification is emitted by the hub once a device finishes
+// uploading a file to blob storage.
+type FileUploadNotification struct {
+	DeviceID        string    `json:"deviceId"`
+	BlobURI         string    `json:"blobUri"`
+	BlobName        string    `json:"blobName"`
+	LastUpdatedTime time.Time `json:"lastUpdatedTime"`
+	BlobSizeInBytes int64     `json:"blobSizeInBytes"`
+	EnqueuedTimeUTC time.Time `json:"enqueuedTimeUtc"`
+}
+
+// FileNotificationFunc handles a file-upload notification and returns how
+// the underlying AMQP message should be settled.
+type FileNotificationFunc func(n *FileUploadNotification) Disposition
+
+// SubscribeFileNotifications subscribes to the file-upload notification
+// queue, invoking fn for every notification and applying its returned
+// Disposition to the underlying AMQP message.
+func (c *Client) SubscribeFileNotifications(ctx context.Context, fn FileNotificationFunc) error {
+	if !c.isConnected() {
+		return errNotConnected
+	}
+	recv, err := c.conn.Sess().NewReceiver(
+		amqp.LinkSourceAddress("/messages/serviceBound/filenotifications"),
+	)
+	if err != nil {
+		return err
+	}
+	defer recv.Close()
+
+	for {
+		msg, err := recv.Receive(ctx)
+		if err != nil {
+			return err
+		}
+
+		n := &FileUploadNotification{}
+		if err := json.Unmarshal(msg.Data[0], n); err != nil {
+			msg.Reject()
+			return err
+		}
+		applyDisposition(msg, fn(n))
+	}
+}
+
+// CompleteFileUpload notifies the hub that a device's file upload has
+// finished, completing the file-upload protocol's handshake. correlationID
+// comes from the device's own upload notification.
+func (c *Client) CompleteFileUpload(
+	ctx context.Context,
+	deviceID, correlationID string,
+	success bool,
+	statusCode int,
+	statusDescription string,
+) error {
+	b, err := json.Marshal(struct {
+		CorrelationID     string `json:"correlationId"`
+		IsSuccess         bool   `json:"isSuccess"`
+		StatusCode        int    `json:"statusCode"`
+		StatusDescription string `json:"statusDescription"`
+	}{correlationID, success, statusCode, statusDescription})
+	if err != nil {
+		return err
+	}
+	_, _, _, err = c.request(ctx, http.MethodPost, "devices/%s/files/notifications", b, nil, deviceID)
+	return err
+}
+
+// MethodCall is a direct-method invocation, shared by Call, CallModule
+// and the jobs v2 ScheduleDeviceMethod request body.
+type MethodCall struct {
 	MethodName      string                 `json:"methodName"`
 	ConnectTimeout  int                    `json:"connectTimeoutInSeconds,omitempty"`
 	ResponseTimeout int                    `json:"responseTimeoutInSeconds,omitempty"`
@@ -404,11 +732,11 @@ type call struct {
 }
 
 // CallOption is a direct-method invocation option.
-type CallOption func(c *call) error
+type CallOption func(c *MethodCall) error
 
 // ConnectTimeout is connection timeout in seconds.
 func WithCallConnectTimeout(seconds int) CallOption {
-	return func(c *call) error {
+	return func(c *MethodCall) error {
 		c.ConnectTimeout = seconds
 		return nil
 	}
@@ -416,7 +744,7 @@ func WithCallConnectTimeout(seconds int) CallOption {
 
 // ResponseTimeout is response timeout in seconds.
 func WithCallResponseTimeout(seconds int) CallOption {
-	return func(c *call) error {
+	return func(c *MethodCall) error {
 		c.ResponseTimeout = seconds
 		return nil
 	}
@@ -440,7 +768,7 @@ func (c *Client) Call(
 		return nil, errors.New("payload is empty")
 	}
 
-	v := &call{
+	v := &MethodCall{
 		MethodName: methodName,
 		Payload:    payload,
 	}
@@ -454,7 +782,7 @@ func (c *Client) Call(
 		return nil, err
 	}
 
-	b, err = c.request(ctx, http.MethodPost, "twins/%s/methods", deviceID, b)
+	_, _, b, err = c.request(ctx, http.MethodPost, "twins/%s/methods", b, nil, deviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -542,7 +870,7 @@ func (c *Client) UpdateTwin(
 	if err != nil {
 		return nil, err
 	}
-	b, err = c.request(ctx, http.MethodPatch, "twins/%s", deviceID, b)
+	_, _, b, err = c.request(ctx, http.MethodPatch, "twins/%s", b, nil, deviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -554,20 +882,10 @@ func (c *Client) UpdateTwin(
 }
 
 // TODO:
-//   createDevice
-//   updateDevice
-//   listDevices
-//   deleteDevice
-//   add/delete/update devices (bulk)
-//   import/export devices from/to blob
-//   listJobs
-//   getJob
-//   cancelJob
 //   getTwin
-//   updateTwin
 //   registryStats
 func (c *Client) GetDevice(ctx context.Context, deviceID string) (*Device, error) {
-	b, err := c.request(ctx, http.MethodGet, "devices/%s", deviceID, nil)
+	_, _, b, err := c.request(ctx, http.MethodGet, "devices/%s", nil, nil, deviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -578,45 +896,850 @@ func (c *Client) GetDevice(ctx context.Context, deviceID string) (*Device, error
 	return d, nil
 }
 
-func (c *Client) request(ctx context.Context, method, path, deviceID string, b []byte) ([]byte, error) {
+// CreateDevice registers a new device identity in the hub's registry.
+func (c *Client) CreateDevice(ctx context.Context, device *Device) (*Device, error) {
+	return c.putDevice(ctx, device, nil)
+}
+
+// UpdateDevice updates an existing device identity.
+//
+// When device.ETag is set, the update is conditional on it matching the
+// server's current ETag, so concurrent writers don't silently clobber
+// each other's changes.
+func (c *Client) UpdateDevice(ctx context.Context, device *Device) (*Device, error) {
+	var h http.Header
+	if device.ETag != "" {
+		h = http.Header{"If-Match": []string{quoteETag(device.ETag)}}
+	}
+	return c.putDevice(ctx, device, h)
+}
+
+func (c *Client) putDevice(ctx context.Context, device *Device, h http.Header) (*Device, error) {
+	b, err := json.Marshal(device)
+	if err != nil {
+		return nil, err
+	}
+	_, _, b, err = c.request(ctx, http.MethodPut, "devices/%s", b, h, device.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	d := &Device{RawJSON: b}
+	if err := json.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DeleteDevice removes the device identity from the registry.
+//
+// etag is optional, pass an empty string to delete unconditionally.
+func (c *Client) DeleteDevice(ctx context.Context, deviceID, etag string) error {
+	h := http.Header{"If-Match": []string{quoteETag(etag)}}
+	if etag == "" {
+		h.Set("If-Match", "*")
+	}
+	_, _, _, err := c.request(ctx, http.MethodDelete, "devices/%s", nil, h, deviceID)
+	return err
+}
+
+// ListDevices lists up to top device identities, or all of them when
+// top is zero, following x-ms-continuation pages.
+func (c *Client) ListDevices(ctx context.Context, top int) ([]*Device, error) {
+	path := "devices"
+	if top > 0 {
+		path = fmt.Sprintf("devices?top=%d", top)
+	}
+	var devices []*Device
+	var continuation string
+	for {
+		reqHeader := http.Header{}
+		if continuation != "" {
+			reqHeader.Set("x-ms-continuation", continuation)
+		}
+		_, h, b, err := c.request(ctx, http.MethodGet, path, nil, reqHeader)
+		if err != nil {
+			return nil, err
+		}
+		var page []*Device
+		if err := json.Unmarshal(b, &page); err != nil {
+			return nil, err
+		}
+		devices = append(devices, page...)
+
+		continuation = h.Get("x-ms-continuation")
+		if continuation == "" || (top > 0 && len(devices) >= top) {
+			break
+		}
+	}
+	return devices, nil
+}
+
+// ImportMode tells the registry what to do with a BulkOp's device entry.
+type ImportMode string
+
+const (
+	ImportModeCreate            ImportMode = "create"
+	ImportModeUpdate            ImportMode = "update"
+	ImportModeUpdateIfMatchETag ImportMode = "updateIfMatchETag"
+	ImportModeDelete            ImportMode = "delete"
+	ImportModeDeleteIfMatchETag ImportMode = "deleteIfMatchETag"
+)
+
+// BulkOp is a single entry of a bulk registry operation, see BulkUpdate.
+type BulkOp struct {
+	ImportMode ImportMode `json:"importMode"`
+	*Device
+}
+
+// BulkUpdateResult is the registry's response to a bulk operation.
+type BulkUpdateResult struct {
+	IsSuccessful bool              `json:"isSuccessful"`
+	Errors       []BulkUpdateError `json:"errors,omitempty"`
+}
+
+// BulkUpdateError describes a single failed op in a BulkUpdate call.
+type BulkUpdateError struct {
+	DeviceID    string `json:"deviceId"`
+	ErrorCode   int    `json:"errorCode"`
+	ErrorStatus string `json:"errorStatus"`
+}
+
+// BulkUpdate creates, updates or deletes up to 100 device identities
+// in a single registry round-trip.
+func (c *Client) BulkUpdate(ctx context.Context, ops []BulkOp) (*BulkUpdateResult, error) {
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	_, _, b, err = c.request(ctx, http.MethodPost, "devices", b, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := &BulkUpdateResult{}
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RegistryJob is a bulk import/export job created by ImportDevicesFromBlob
+// or ExportDevicesToBlob.
+type RegistryJob struct {
+	JobID                  string `json:"jobId"`
+	Type                   string `json:"type"`
+	Status                 string `json:"status"`
+	StartTimeUtc           string `json:"startTimeUtc,omitempty"`
+	EndTimeUtc             string `json:"endTimeUtc,omitempty"`
+	Progress               int    `json:"progress"`
+	InputBlobContainerUri  string `json:"inputBlobContainerUri,omitempty"`
+	OutputBlobContainerUri string `json:"outputBlobContainerUri,omitempty"`
+	ExcludeKeysInExport    bool   `json:"excludeKeysInExport,omitempty"`
+	FailureReason          string `json:"failureReason,omitempty"`
+}
+
+// ImportDevicesFromBlob kicks off a registry import job that reads device
+// identities from inputBlobURI and writes the outcome log to outputBlobURI.
+func (c *Client) ImportDevicesFromBlob(ctx context.Context, inputBlobURI, outputBlobURI string) (*RegistryJob, error) {
+	return c.createRegistryJob(ctx, map[string]interface{}{
+		"type":                   "import",
+		"inputBlobContainerUri":  inputBlobURI,
+		"outputBlobContainerUri": outputBlobURI,
+	})
+}
+
+// ExportDevicesToBlob kicks off a registry export job that writes all
+// device identities to outputBlobURI. When excludeKeys is true, the
+// exported documents omit device authentication keys.
+func (c *Client) ExportDevicesToBlob(ctx context.Context, outputBlobURI string, excludeKeys bool) (*RegistryJob, error) {
+	return c.createRegistryJob(ctx, map[string]interface{}{
+		"type":                   "export",
+		"outputBlobContainerUri": outputBlobURI,
+		"excludeKeysInExport":    excludeKeys,
+	})
+}
+
+func (c *Client) createRegistryJob(ctx context.Context, body map[string]interface{}) (*RegistryJob, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	_, _, b, err = c.request(ctx, http.MethodPost, "jobs/create", b, nil)
+	if err != nil {
+		return nil, err
+	}
+	j := &RegistryJob{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// GetRegistryJob returns the current status of an import/export job
+// started by ImportDevicesFromBlob or ExportDevicesToBlob.
+func (c *Client) GetRegistryJob(ctx context.Context, jobID string) (*RegistryJob, error) {
+	_, _, b, err := c.request(ctx, http.MethodGet, "jobs/%s", nil, nil, jobID)
+	if err != nil {
+		return nil, err
+	}
+	j := &RegistryJob{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// CancelRegistryJob cancels a running import/export job.
+func (c *Client) CancelRegistryJob(ctx context.Context, jobID string) error {
+	_, _, _, err := c.request(ctx, http.MethodDelete, "jobs/%s", nil, nil, jobID)
+	return err
+}
+
+// JobType is the kind of work a jobs v2 job performs.
+type JobType string
+
+const (
+	JobTypeScheduleDeviceMethod JobType = "scheduleDeviceMethod"
+	JobTypeScheduleUpdateTwin   JobType = "scheduleUpdateTwin"
+)
+
+// JobStatus is the current state of a jobs v2 job.
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusScheduled JobStatus = "scheduled"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusCompleted JobStatus = "completed"
+	JobStatusFailed    JobStatus = "failed"
+	JobStatusCancelled JobStatus = "cancelled"
+)
+
+// DeviceJobStatistics summarizes how a jobs v2 job's device set is
+// progressing.
+type DeviceJobStatistics struct {
+	DeviceCount    int `json:"deviceCount"`
+	FailedCount    int `json:"failedCount"`
+	SucceededCount int `json:"succeededCount"`
+	RunningCount   int `json:"runningCount"`
+	PendingCount   int `json:"pendingCount"`
+}
+
+// Job is a jobs v2 job: a twin update or direct method invocation fanned
+// out to every device matched by QueryCondition.
+//
+// https://docs.microsoft.com/en-us/rest/api/iothub/service/jobs
+type Job struct {
+	JobID                     string              `json:"jobId"`
+	Type                      JobType             `json:"type"`
+	Status                    JobStatus           `json:"status"`
+	QueryCondition            string              `json:"queryCondition,omitempty"`
+	CreatedTime               string              `json:"createdTime,omitempty"`
+	StartTime                 string              `json:"startTime,omitempty"`
+	EndTime                   string              `json:"endTime,omitempty"`
+	MaxExecutionTimeInSeconds int                 `json:"maxExecutionTimeInSeconds,omitempty"`
+	UpdateTwin                *Twin               `json:"updateTwin,omitempty"`
+	CloudToDeviceMethod       *MethodCall         `json:"cloudToDeviceMethod,omitempty"`
+	FailureReason             string              `json:"failureReason,omitempty"`
+	StatusMessage             string              `json:"statusMessage,omitempty"`
+	DeviceJobStatistics       DeviceJobStatistics `json:"deviceJobStatistics"`
+}
+
+// ScheduleTwinUpdate schedules a twin patch to be applied to every device
+// matched by queryCondition, e.g. "deviceId IN ['a','b']" or a tag-based
+// SQL condition.
+func (c *Client) ScheduleTwinUpdate(
+	ctx context.Context,
+	jobID, queryCondition string,
+	twinPatch *Twin,
+	startTime time.Time,
+	maxExecutionSeconds int,
+) (*Job, error) {
+	return c.putJob(ctx, &Job{
+		JobID:                     jobID,
+		Type:                      JobTypeScheduleUpdateTwin,
+		QueryCondition:            queryCondition,
+		StartTime:                 startTime.UTC().Format(time.RFC3339),
+		MaxExecutionTimeInSeconds: maxExecutionSeconds,
+		UpdateTwin:                twinPatch,
+	})
+}
+
+// ScheduleDeviceMethod schedules a direct method call to be invoked on
+// every device matched by queryCondition.
+func (c *Client) ScheduleDeviceMethod(
+	ctx context.Context,
+	jobID, queryCondition string,
+	methodName string,
+	payload map[string]interface{},
+	startTime time.Time,
+	maxExecutionSeconds int,
+) (*Job, error) {
+	return c.putJob(ctx, &Job{
+		JobID:                     jobID,
+		Type:                      JobTypeScheduleDeviceMethod,
+		QueryCondition:            queryCondition,
+		StartTime:                 startTime.UTC().Format(time.RFC3339),
+		MaxExecutionTimeInSeconds: maxExecutionSeconds,
+		CloudToDeviceMethod: &MethodCall{
+			MethodName: methodName,
+			Payload:    payload,
+		},
+	})
+}
+
+func (c *Client) putJob(ctx context.Context, j *Job) (*Job, error) {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+	_, _, b, err = c.request(ctx, http.MethodPut, "jobs/v2/%s", b, nil, j.JobID)
+	if err != nil {
+		return nil, err
+	}
+	res := &Job{}
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetJob returns the current status of a jobs v2 job.
+func (c *Client) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	_, _, b, err := c.request(ctx, http.MethodGet, "jobs/v2/%s", nil, nil, jobID)
+	if err != nil {
+		return nil, err
+	}
+	j := &Job{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// CancelJob cancels a running or scheduled jobs v2 job.
+func (c *Client) CancelJob(ctx context.Context, jobID string) (*Job, error) {
+	_, _, b, err := c.request(ctx, http.MethodPost, "jobs/v2/%s/cancel", nil, nil, jobID)
+	if err != nil {
+		return nil, err
+	}
+	j := &Job{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// QueryJobs returns jobs v2 jobs matching the given type and status,
+// following x-ms-continuation pages until the result set is exhausted.
+// Either filter may be left empty to match any value.
+func (c *Client) QueryJobs(ctx context.Context, jobType JobType, jobStatus JobStatus) ([]*Job, error) {
+	path := "jobs/v2/query"
+	if jobType != "" {
+		path += "?jobType=" + url.QueryEscape(string(jobType))
+	}
+	if jobStatus != "" {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "jobStatus=" + url.QueryEscape(string(jobStatus))
+	}
+
+	var jobs []*Job
+	var continuation string
+	for {
+		reqHeader := http.Header{}
+		if continuation != "" {
+			reqHeader.Set("x-ms-continuation", continuation)
+		}
+		_, h, b, err := c.request(ctx, http.MethodGet, path, nil, reqHeader)
+		if err != nil {
+			return nil, err
+		}
+		var page []*Job
+		if err := json.Unmarshal(b, &page); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, page...)
+
+		continuation = h.Get("x-ms-continuation")
+		if continuation == "" {
+			break
+		}
+	}
+	return jobs, nil
+}
+
+// Query runs an IoT Hub SQL-like query against devices, twins or jobs,
+// paging results via the x-ms-continuation header.
+//
+// https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-devguide-query-language
+type Query struct {
+	c        *Client
+	query    string
+	pageSize int
+
+	continuation string
+	more         bool
+}
+
+// Query creates a query, call Next to run it and fetch pages of results.
+func (c *Client) Query(query string) *Query {
+	return &Query{c: c, query: query, more: true}
+}
+
+// WithPageSize sets x-ms-max-item-count for subsequent Next calls,
+// the hub treats it as an upper bound rather than a guarantee.
+func (q *Query) WithPageSize(n int) *Query {
+	q.pageSize = n
+	return q
+}
+
+// HasMore reports whether a subsequent call to Next can return more
+// results. It's true before the first call to Next.
+func (q *Query) HasMore() bool {
+	return q.more
+}
+
+// Next fetches the next page of results into v, which should be a
+// pointer to []*Twin or []*Job for device/twin/job queries, or to
+// []map[string]interface{} (or a narrower aggregate type) for queries
+// like "SELECT COUNT() FROM devices GROUP BY tags.building". It returns
+// io.EOF once HasMore reports false.
+func (q *Query) Next(ctx context.Context, v interface{}) error {
+	if !q.more {
+		return io.EOF
+	}
+
+	b, err := json.Marshal(struct {
+		Query string `json:"query"`
+	}{q.query})
+	if err != nil {
+		return err
+	}
+
+	h := http.Header{}
+	if q.continuation != "" {
+		h.Set("x-ms-continuation", q.continuation)
+	}
+	if q.pageSize > 0 {
+		h.Set("x-ms-max-item-count", strconv.Itoa(q.pageSize))
+	}
+
+	_, rh, b, err := q.c.request(ctx, http.MethodPost, "devices/query", b, h)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return err
+	}
+
+	q.continuation = rh.Get("x-ms-continuation")
+	q.more = q.continuation != ""
+	return nil
+}
+
+// Module is an IoT Edge or multiplexed module identity, scoped to its
+// parent device.
+type Module struct {
+	ModuleID                   string `json:"moduleId"`
+	DeviceID                   string `json:"deviceId"`
+	GenerationID               string `json:"generationId,omitempty"`
+	ETag                       string `json:"etag,omitempty"`
+	ConnectionState            string `json:"connectionState,omitempty"`
+	ConnectionStateUpdatedTime string `json:"connectionStateUpdatedTime,omitempty"`
+	LastActivityTime           string `json:"lastActivityTime,omitempty"`
+	CloudToDeviceMessageCount  int    `json:"cloudToDeviceMessageCount,omitempty"`
+	Authentication             struct {
+		X509Thumbprint X509Thumbprint `json:"x509Thumbprint"`
+		Type           string         `json:"type"`
+	} `json:"authentication"`
+	ManagedBy string `json:"managedBy,omitempty"`
+
+	RawJSON []byte `json:"-"`
+}
+
+// CreateModule registers a new module identity under a device.
+func (c *Client) CreateModule(ctx context.Context, module *Module) (*Module, error) {
+	return c.putModule(ctx, module, nil)
+}
+
+// UpdateModule updates an existing module identity, conditional on
+// module.ETag when it's set.
+func (c *Client) UpdateModule(ctx context.Context, module *Module) (*Module, error) {
+	var h http.Header
+	if module.ETag != "" {
+		h = http.Header{"If-Match": []string{quoteETag(module.ETag)}}
+	}
+	return c.putModule(ctx, module, h)
+}
+
+func (c *Client) putModule(ctx context.Context, module *Module, h http.Header) (*Module, error) {
+	b, err := json.Marshal(module)
+	if err != nil {
+		return nil, err
+	}
+	_, _, b, err = c.request(ctx, http.MethodPut, "devices/%s/modules/%s", b, h, module.DeviceID, module.ModuleID)
+	if err != nil {
+		return nil, err
+	}
+	m := &Module{RawJSON: b}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetModule returns a single module identity.
+func (c *Client) GetModule(ctx context.Context, deviceID, moduleID string) (*Module, error) {
+	_, _, b, err := c.request(ctx, http.MethodGet, "devices/%s/modules/%s", nil, nil, deviceID, moduleID)
+	if err != nil {
+		return nil, err
+	}
+	m := &Module{RawJSON: b}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DeleteModule removes a module identity. etag is optional, pass an
+// empty string to delete unconditionally.
+func (c *Client) DeleteModule(ctx context.Context, deviceID, moduleID, etag string) error {
+	h := http.Header{"If-Match": []string{quoteETag(etag)}}
+	if etag == "" {
+		h.Set("If-Match", "*")
+	}
+	_, _, _, err := c.request(ctx, http.MethodDelete, "devices/%s/modules/%s", nil, h, deviceID, moduleID)
+	return err
+}
+
+// ListModules lists every module identity registered under a device.
+func (c *Client) ListModules(ctx context.Context, deviceID string) ([]*Module, error) {
+	_, _, b, err := c.request(ctx, http.MethodGet, "devices/%s/modules", nil, nil, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	var modules []*Module
+	if err := json.Unmarshal(b, &modules); err != nil {
+		return nil, err
+	}
+	return modules, nil
+}
+
+// GetModuleTwin returns the twin of a module.
+func (c *Client) GetModuleTwin(ctx context.Context, deviceID, moduleID string) (*Twin, error) {
+	_, _, b, err := c.request(ctx, http.MethodGet, "twins/%s/modules/%s", nil, nil, deviceID, moduleID)
+	if err != nil {
+		return nil, err
+	}
+	t := &Twin{RawJSON: b}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// UpdateModuleTwin applies a desired-properties patch to a module's twin.
+func (c *Client) UpdateModuleTwin(
+	ctx context.Context,
+	deviceID, moduleID string,
+	patch map[string]interface{},
+) (*Twin, error) {
+	b, err := json.Marshal(&Twin{
+		Properties: Properties{
+			Desired: patch,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, _, b, err = c.request(ctx, http.MethodPatch, "twins/%s/modules/%s", b, nil, deviceID, moduleID)
+	if err != nil {
+		return nil, err
+	}
+	t := &Twin{RawJSON: b}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// CallModule invokes a direct method on a module, same semantics as Call
+// but scoped to a module identity rather than the device itself.
+func (c *Client) CallModule(
+	ctx context.Context,
+	deviceID, moduleID string,
+	methodName string,
+	payload map[string]interface{},
+	opts ...CallOption,
+) (map[string]interface{}, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	if moduleID == "" {
+		return nil, errors.New("moduleID is empty")
+	}
+	if methodName == "" {
+		return nil, errors.New("methodName is empty")
+	}
+	if len(payload) == 0 {
+		return nil, errors.New("payload is empty")
+	}
+
+	v := &MethodCall{
+		MethodName: methodName,
+		Payload:    payload,
+	}
+	for _, opt := range opts {
+		if err := opt(v); err != nil {
+			return nil, err
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, b, err = c.request(ctx, http.MethodPost, "twins/%s/modules/%s/methods", b, nil, deviceID, moduleID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ir struct {
+		Status  int
+		Payload map[string]interface{}
+	}
+	return ir.Payload, json.Unmarshal(b, &ir)
+}
+
+// ConfigurationContent is the modules and/or device twin content a
+// Configuration applies to its target device set.
+type ConfigurationContent struct {
+	ModulesContent map[string]map[string]interface{} `json:"modulesContent,omitempty"`
+	DeviceContent  map[string]interface{}            `json:"deviceContent,omitempty"`
+}
+
+// ConfigurationMetrics is a set of named queries and, once the
+// configuration has run, their result counts.
+type ConfigurationMetrics struct {
+	Results map[string]int    `json:"results,omitempty"`
+	Queries map[string]string `json:"queries,omitempty"`
+}
+
+// Configuration is an IoT Edge deployment or device twin configuration
+// that's automatically applied to every device matched by
+// TargetCondition.
+//
+// https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-devguide-configurations
+type Configuration struct {
+	ID                 string               `json:"id"`
+	SchemaVersion      string               `json:"schemaVersion,omitempty"`
+	Labels             map[string]string    `json:"labels,omitempty"`
+	Content            ConfigurationContent `json:"content"`
+	TargetCondition    string               `json:"targetCondition,omitempty"`
+	Priority           int                  `json:"priority,omitempty"`
+	SystemMetrics      ConfigurationMetrics `json:"systemMetrics,omitempty"`
+	Metrics            ConfigurationMetrics `json:"metrics,omitempty"`
+	ETag               string               `json:"etag,omitempty"`
+	CreatedTimeUtc     string               `json:"createdTimeUtc,omitempty"`
+	LastUpdatedTimeUtc string               `json:"lastUpdatedTimeUtc,omitempty"`
+
+	RawJSON []byte `json:"-"`
+}
+
+// CreateConfiguration creates a new deployment/configuration.
+func (c *Client) CreateConfiguration(ctx context.Context, config *Configuration) (*Configuration, error) {
+	return c.putConfiguration(ctx, config, nil)
+}
+
+// UpdateConfiguration updates an existing configuration, conditional on
+// config.ETag when it's set.
+func (c *Client) UpdateConfiguration(ctx context.Context, config *Configuration) (*Configuration, error) {
+	var h http.Header
+	if config.ETag != "" {
+		h = http.Header{"If-Match": []string{quoteETag(config.ETag)}}
+	}
+	return c.putConfiguration(ctx, config, h)
+}
+
+func (c *Client) putConfiguration(ctx context.Context, config *Configuration, h http.Header) (*Configuration, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	_, _, b, err = c.request(ctx, http.MethodPut, "configurations/%s", b, h, config.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := &Configuration{RawJSON: b}
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetConfiguration returns a single configuration.
+func (c *Client) GetConfiguration(ctx context.Context, configID string) (*Configuration, error) {
+	_, _, b, err := c.request(ctx, http.MethodGet, "configurations/%s", nil, nil, configID)
+	if err != nil {
+		return nil, err
+	}
+	res := &Configuration{RawJSON: b}
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteConfiguration removes a configuration. etag is optional, pass
+// an empty string to delete unconditionally.
+func (c *Client) DeleteConfiguration(ctx context.Context, configID, etag string) error {
+	h := http.Header{"If-Match": []string{quoteETag(etag)}}
+	if etag == "" {
+		h.Set("If-Match", "*")
+	}
+	_, _, _, err := c.request(ctx, http.MethodDelete, "configurations/%s", nil, h, configID)
+	return err
+}
+
+// ListConfigurations lists up to top configurations, or all of them
+// when top is zero.
+func (c *Client) ListConfigurations(ctx context.Context, top int) ([]*Configuration, error) {
+	path := "configurations"
+	if top > 0 {
+		path = fmt.Sprintf("configurations?top=%d", top)
+	}
+	_, _, b, err := c.request(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*Configuration
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// ApplyConfigurationOnDevice pushes module and/or device twin content to
+// a single device directly, bypassing TargetCondition targeting. Useful
+// for testing a configuration against one device before rolling it out.
+func (c *Client) ApplyConfigurationOnDevice(ctx context.Context, deviceID string, content *ConfigurationContent) error {
+	b, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = c.request(ctx, http.MethodPost, "devices/%s/applyConfigurationContent", b, nil, deviceID)
+	return err
+}
+
+// quoteETag wraps an ETag in double quotes unless it's already quoted,
+// the registry API rejects unquoted If-Match values.
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, `"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// sasTokenLifetime is how long a REST SAS token is valid for once
+// generated. sasToken regenerates it well before it expires, so requests
+// never carry an expired token.
+const sasTokenLifetime = time.Hour
+
+// sasRefreshDeadline returns when a SAS token issued at issuedAt with the
+// given lifetime should be regenerated, ~80% of the way through its
+// lifetime. The regeneration happens inside the first request made after
+// that point, which signs the new token before it is sent.
+func sasRefreshDeadline(issuedAt time.Time, lifetime time.Duration) time.Time {
+	return issuedAt.Add(lifetime * 4 / 5)
+}
+
+// sasToken returns a cached SAS token for REST calls, regenerating it
+// once it's past ~80% of its lifetime.
+func (c *Client) sasToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sas != "" && time.Now().Before(c.sasRefreshAt) {
+		return c.sas, nil
+	}
+
+	sas, err := c.creds.SAS(c.creds.HostName, sasTokenLifetime)
+	if err != nil {
+		return "", err
+	}
+	c.sas = sas
+	c.sasRefreshAt = sasRefreshDeadline(time.Now(), sasTokenLifetime)
+	return c.sas, nil
+}
+
+// request performs an authenticated REST call against the hub's HTTPS
+// endpoint. path is a format string applied with pathArgs, each of which
+// is URL-escaped before being substituted in. reqHeader, when non-nil, is
+// merged into the request headers, useful for conditional If-Match writes.
+// It returns the response status code and headers in addition to the body
+// so that callers can inspect things like the ETag or Location the
+// registry/jobs APIs hand back.
+func (c *Client) request(
+	ctx context.Context,
+	method, path string,
+	b []byte,
+	reqHeader http.Header,
+	pathArgs ...interface{},
+) (int, http.Header, []byte, error) {
+	escaped := make([]interface{}, 0, len(pathArgs)+2)
+	escaped = append(escaped, c.creds.HostName)
+	for _, a := range pathArgs {
+		escaped = append(escaped, url.PathEscape(fmt.Sprint(a)))
+	}
+	escaped = append(escaped, common.APIVersion)
+
+	sep := "?api-version=%s"
+	if strings.Contains(path, "?") {
+		sep = "&api-version=%s"
+	}
 	r, err := http.NewRequest(method,
-		fmt.Sprintf("https://%s/"+path+"?api-version=%s",
-			c.creds.HostName, url.PathEscape(deviceID), common.APIVersion),
+		fmt.Sprintf("https://%s/"+path+sep, escaped...),
 		bytes.NewReader(b),
 	)
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
 
-	// TODO: cache sas
-	sas, err := c.creds.SAS(c.creds.HostName, time.Hour)
+	sas, err := c.sasToken()
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
 	rid, err := eventhub.RandString()
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
 
 	r.Header.Set("Content-Type", "application/json; charset=utf-8")
 	r.Header.Set("Authorization", sas)
 	r.Header.Set("Request-Id", rid)
-	r.WithContext(ctx)
+	for k, vs := range reqHeader {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	r = r.WithContext(ctx)
 
 	res, err := c.http.Do(r)
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
 	defer res.Body.Close()
 
 	b, err = ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("code = %d, body = %q", res.StatusCode, string(b))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, res.Header, nil, fmt.Errorf("code = %d, body = %q", res.StatusCode, string(b))
 	}
-	return b, nil
+	return res.StatusCode, res.Header, b, nil
 }
 
 func (c *Client) logf(format string, v ...interface{}) {
@@ -641,6 +1764,10 @@ func (c *Client) Close() error {
 	default:
 		close(c.done)
 	}
+	for addr, l := range c.senders {
+		l.sender.Close()
+		delete(c.senders, addr)
+	}
 	if c.conn == nil {
 		return nil
 	}
@@ -0,0 +1,41 @@
+package iotservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOldestSenderAddr(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	senders := map[string]*senderLink{
+		"a": {lastUsed: now.Add(-3 * time.Minute)},
+		"b": {lastUsed: now.Add(-1 * time.Minute)},
+		"c": {lastUsed: now.Add(-5 * time.Minute)},
+	}
+	if got := oldestSenderAddr(senders); got != "c" {
+		t.Fatalf("oldestSenderAddr() = %q, want %q", got, "c")
+	}
+}
+
+func TestOldestSenderAddrEmpty(t *testing.T) {
+	if got := oldestSenderAddr(nil); got != "" {
+		t.Fatalf("oldestSenderAddr(nil) = %q, want empty string", got)
+	}
+}
+
+func TestSasRefreshDeadline(t *testing.T) {
+	issuedAt := time.Unix(1700000000, 0)
+	deadline := sasRefreshDeadline(issuedAt, time.Hour)
+
+	want := issuedAt.Add(48 * time.Minute) // 80% of an hour
+	if !deadline.Equal(want) {
+		t.Fatalf("sasRefreshDeadline() = %v, want %v", deadline, want)
+	}
+
+	if !issuedAt.Add(47 * time.Minute).Before(deadline) {
+		t.Fatalf("expected a token requested at 47m to still be before the refresh deadline")
+	}
+	if issuedAt.Add(49 * time.Minute).Before(deadline) {
+		t.Fatalf("expected a token requested at 49m to be at/after the refresh deadline")
+	}
+}
@@ -0,0 +1,34 @@
+package iotservice
+
+import "testing"
+
+type fakeSettler struct {
+	accepted bool
+	released bool
+	rejected bool
+}
+
+func (f *fakeSettler) Accept()  { f.accepted = true }
+func (f *fakeSettler) Release() { f.released = true }
+func (f *fakeSettler) Reject()  { f.rejected = true }
+
+func TestApplyDisposition(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		d    Disposition
+		ok   func(*fakeSettler) bool
+	}{
+		{"accept", Accept, func(f *fakeSettler) bool { return f.accepted }},
+		{"abandon releases", Abandon, func(f *fakeSettler) bool { return f.released }},
+		{"reject", Reject, func(f *fakeSettler) bool { return f.rejected }},
+		{"unknown defaults to accept", Disposition(99), func(f *fakeSettler) bool { return f.accepted }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeSettler{}
+			applyDisposition(f, tc.d)
+			if !tc.ok(f) {
+				t.Fatalf("disposition %v didn't settle the message as expected: %+v", tc.d, f)
+			}
+		})
+	}
+}
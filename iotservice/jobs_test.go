@@ -0,0 +1,119 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/golang-iothub/common"
+)
+
+func TestScheduleTwinUpdatePath(t *testing.T) {
+	var gotMethod, gotPath string
+	var gotBody Job
+	var decodeErr error
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		decodeErr = json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&gotBody)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	start := time.Unix(1700000000, 0)
+	desired := map[string]interface{}{"firmware": "v2"}
+
+	if _, err := c.ScheduleTwinUpdate(context.Background(), "job1", "deviceId IN ['d1']",
+		&Twin{Properties: Properties{Desired: desired}}, start, 120); err != nil {
+		t.Fatalf("ScheduleTwinUpdate() error = %v", err)
+	}
+	if decodeErr != nil {
+		t.Fatalf("server failed to decode request body: %v", decodeErr)
+	}
+	if gotMethod != http.MethodPut {
+		t.Fatalf("method = %q, want %q", gotMethod, http.MethodPut)
+	}
+	if gotPath != "/jobs/v2/job1" {
+		t.Fatalf("path = %q, want %q", gotPath, "/jobs/v2/job1")
+	}
+	if gotBody.Type != JobTypeScheduleUpdateTwin {
+		t.Fatalf("job type = %q, want %q", gotBody.Type, JobTypeScheduleUpdateTwin)
+	}
+	if gotBody.QueryCondition != "deviceId IN ['d1']" {
+		t.Fatalf("queryCondition = %q, want %q", gotBody.QueryCondition, "deviceId IN ['d1']")
+	}
+	if gotBody.MaxExecutionTimeInSeconds != 120 {
+		t.Fatalf("maxExecutionTimeInSeconds = %d, want 120", gotBody.MaxExecutionTimeInSeconds)
+	}
+	if gotBody.UpdateTwin == nil || gotBody.UpdateTwin.Properties.Desired["firmware"] != "v2" {
+		t.Fatalf("updateTwin = %+v, want desired.firmware = v2", gotBody.UpdateTwin)
+	}
+}
+
+func TestScheduleDeviceMethodPath(t *testing.T) {
+	var gotPath string
+	var gotBody Job
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&gotBody)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	payload := map[string]interface{}{"reboot": true}
+
+	if _, err := c.ScheduleDeviceMethod(context.Background(), "job2", "deviceId='d1'",
+		"reboot", payload, time.Unix(1700000000, 0), 60); err != nil {
+		t.Fatalf("ScheduleDeviceMethod() error = %v", err)
+	}
+	if gotPath != "/jobs/v2/job2" {
+		t.Fatalf("path = %q, want %q", gotPath, "/jobs/v2/job2")
+	}
+	if gotBody.Type != JobTypeScheduleDeviceMethod {
+		t.Fatalf("job type = %q, want %q", gotBody.Type, JobTypeScheduleDeviceMethod)
+	}
+	if gotBody.CloudToDeviceMethod == nil || gotBody.CloudToDeviceMethod.MethodName != "reboot" {
+		t.Fatalf("cloudToDeviceMethod = %+v, want methodName = reboot", gotBody.CloudToDeviceMethod)
+	}
+}
+
+func TestQueryJobsContinuation(t *testing.T) {
+	var calls int
+	var gotPaths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		gotPaths = append(gotPaths, r.URL.Path+"?"+r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+		switch calls {
+		case 1:
+			w.Header().Set("x-ms-continuation", "page2-token")
+			w.Write([]byte(`[{"jobId":"j1"}]`))
+		default:
+			w.Write([]byte(`[{"jobId":"j2"}]`))
+		}
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	jobs, err := c.QueryJobs(context.Background(), JobTypeScheduleUpdateTwin, JobStatusRunning)
+	if err != nil {
+		t.Fatalf("QueryJobs() error = %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].JobID != "j1" || jobs[1].JobID != "j2" {
+		t.Fatalf("jobs = %+v, want [j1 j2]", jobs)
+	}
+	if calls != 2 {
+		t.Fatalf("server got %d requests, want 2", calls)
+	}
+	want := "/jobs/v2/query?jobType=scheduleUpdateTwin&jobStatus=running&api-version=" + common.APIVersion
+	if gotPaths[0] != want {
+		t.Fatalf("first request path = %q, want %q", gotPaths[0], want)
+	}
+}
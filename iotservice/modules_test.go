@@ -0,0 +1,126 @@
+package iotservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amenzhinsky/golang-iothub/common"
+)
+
+func TestModulePaths(t *testing.T) {
+	var gotMethod, gotPath, gotIfMatch string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		gotIfMatch = r.Header.Get("If-Match")
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/devices/dev1/modules" {
+			w.Write([]byte(`[{"deviceId":"dev1","moduleId":"mod1"}]`))
+			return
+		}
+		w.Write([]byte(`{"deviceId":"dev1","moduleId":"mod1","etag":"BBBB"}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+
+	if _, err := c.CreateModule(context.Background(), &Module{DeviceID: "dev1", ModuleID: "mod1"}); err != nil {
+		t.Fatalf("CreateModule() error = %v", err)
+	}
+	if gotMethod != http.MethodPut || gotPath != "/devices/dev1/modules/mod1" {
+		t.Fatalf("CreateModule request = %s %s, want PUT /devices/dev1/modules/mod1", gotMethod, gotPath)
+	}
+	if gotIfMatch != "" {
+		t.Fatalf("CreateModule sent If-Match = %q, want none", gotIfMatch)
+	}
+
+	if _, err := c.UpdateModule(context.Background(), &Module{DeviceID: "dev1", ModuleID: "mod1", ETag: "BBBB"}); err != nil {
+		t.Fatalf("UpdateModule() error = %v", err)
+	}
+	if want := `"BBBB"`; gotIfMatch != want {
+		t.Fatalf("UpdateModule If-Match = %q, want %q", gotIfMatch, want)
+	}
+
+	if err := c.DeleteModule(context.Background(), "dev1", "mod1", ""); err != nil {
+		t.Fatalf("DeleteModule() error = %v", err)
+	}
+	if gotMethod != http.MethodDelete || gotPath != "/devices/dev1/modules/mod1" {
+		t.Fatalf("DeleteModule request = %s %s, want DELETE /devices/dev1/modules/mod1", gotMethod, gotPath)
+	}
+	if gotIfMatch != "*" {
+		t.Fatalf("DeleteModule with no etag sent If-Match = %q, want %q", gotIfMatch, "*")
+	}
+
+	if _, err := c.ListModules(context.Background(), "dev1"); err != nil {
+		t.Fatalf("ListModules() error = %v", err)
+	}
+	if gotMethod != http.MethodGet || gotPath != "/devices/dev1/modules" {
+		t.Fatalf("ListModules request = %s %s, want GET /devices/dev1/modules", gotMethod, gotPath)
+	}
+}
+
+func TestConfigurationPaths(t *testing.T) {
+	var gotMethod, gotPath, gotIfMatch string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		gotIfMatch = r.Header.Get("If-Match")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"cfg1","etag":"CCCC"}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+
+	if _, err := c.CreateConfiguration(context.Background(), &Configuration{ID: "cfg1"}); err != nil {
+		t.Fatalf("CreateConfiguration() error = %v", err)
+	}
+	if gotMethod != http.MethodPut || gotPath != "/configurations/cfg1" {
+		t.Fatalf("CreateConfiguration request = %s %s, want PUT /configurations/cfg1", gotMethod, gotPath)
+	}
+	if gotIfMatch != "" {
+		t.Fatalf("CreateConfiguration sent If-Match = %q, want none", gotIfMatch)
+	}
+
+	if _, err := c.UpdateConfiguration(context.Background(), &Configuration{ID: "cfg1", ETag: "CCCC"}); err != nil {
+		t.Fatalf("UpdateConfiguration() error = %v", err)
+	}
+	if want := `"CCCC"`; gotIfMatch != want {
+		t.Fatalf("UpdateConfiguration If-Match = %q, want %q", gotIfMatch, want)
+	}
+
+	if err := c.DeleteConfiguration(context.Background(), "cfg1", ""); err != nil {
+		t.Fatalf("DeleteConfiguration() error = %v", err)
+	}
+	if gotMethod != http.MethodDelete || gotIfMatch != "*" {
+		t.Fatalf("DeleteConfiguration request = %s If-Match=%q, want DELETE If-Match=*", gotMethod, gotIfMatch)
+	}
+}
+
+func TestListConfigurationsPath(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path + "?" + r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+
+	if _, err := c.ListConfigurations(context.Background(), 0); err != nil {
+		t.Fatalf("ListConfigurations(0) error = %v", err)
+	}
+	if want := "/configurations?api-version=" + common.APIVersion; gotPath != want {
+		t.Fatalf("ListConfigurations(0) path = %q, want %q", gotPath, want)
+	}
+
+	if _, err := c.ListConfigurations(context.Background(), 10); err != nil {
+		t.Fatalf("ListConfigurations(10) error = %v", err)
+	}
+	if want := "/configurations?top=10&api-version=" + common.APIVersion; gotPath != want {
+		t.Fatalf("ListConfigurations(10) path = %q, want %q", gotPath, want)
+	}
+}
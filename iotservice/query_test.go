@@ -0,0 +1,140 @@
+package iotservice
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryNextOnePage(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"deviceId":"d1"}]`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	q := c.Query("SELECT * FROM devices")
+
+	if !q.HasMore() {
+		t.Fatalf("HasMore() = false before the first Next, want true")
+	}
+
+	var page []*Twin
+	if err := q.Next(context.Background(), &page); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if len(page) != 1 || page[0].DeviceID != "d1" {
+		t.Fatalf("page = %+v, want one twin d1", page)
+	}
+	if q.HasMore() {
+		t.Fatalf("HasMore() = true after a page with no continuation token")
+	}
+	if calls != 1 {
+		t.Fatalf("server got %d requests, want 1", calls)
+	}
+
+	if err := q.Next(context.Background(), &page); err != io.EOF {
+		t.Fatalf("Next() after exhaustion error = %v, want io.EOF", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Next() after HasMore() == false should not hit the server, got %d requests", calls)
+	}
+}
+
+func TestQueryNextTwoPages(t *testing.T) {
+	var calls int
+	var gotContinuations []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		gotContinuations = append(gotContinuations, r.Header.Get("x-ms-continuation"))
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			w.Header().Set("x-ms-continuation", "page2-token")
+			w.Write([]byte(`[{"deviceId":"d1"}]`))
+			return
+		}
+		w.Write([]byte(`[{"deviceId":"d2"}]`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	q := c.Query("SELECT * FROM devices")
+
+	var page1 []*Twin
+	if err := q.Next(context.Background(), &page1); err != nil {
+		t.Fatalf("Next() #1 error = %v", err)
+	}
+	if len(page1) != 1 || page1[0].DeviceID != "d1" {
+		t.Fatalf("page1 = %+v, want one twin d1", page1)
+	}
+	if !q.HasMore() {
+		t.Fatalf("HasMore() = false after a continuation token was returned")
+	}
+
+	var page2 []*Twin
+	if err := q.Next(context.Background(), &page2); err != nil {
+		t.Fatalf("Next() #2 error = %v", err)
+	}
+	if len(page2) != 1 || page2[0].DeviceID != "d2" {
+		t.Fatalf("page2 = %+v, want one twin d2", page2)
+	}
+	if q.HasMore() {
+		t.Fatalf("HasMore() = true after the last page had no continuation token")
+	}
+	if calls != 2 {
+		t.Fatalf("server got %d requests, want 2", calls)
+	}
+	if gotContinuations[0] != "" {
+		t.Fatalf("first request sent x-ms-continuation = %q, want empty", gotContinuations[0])
+	}
+	if gotContinuations[1] != "page2-token" {
+		t.Fatalf("second request sent x-ms-continuation = %q, want %q", gotContinuations[1], "page2-token")
+	}
+}
+
+func TestQueryPageSizeHeader(t *testing.T) {
+	var gotMaxItemCount string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMaxItemCount = r.Header.Get("x-ms-max-item-count")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	q := c.Query("SELECT * FROM devices").WithPageSize(25)
+
+	var page []*Twin
+	if err := q.Next(context.Background(), &page); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if gotMaxItemCount != "25" {
+		t.Fatalf("x-ms-max-item-count = %q, want %q", gotMaxItemCount, "25")
+	}
+}
+
+func TestQueryNoPageSizeOmitsHeader(t *testing.T) {
+	var sawHeader bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawHeader = len(r.Header["X-Ms-Max-Item-Count"]) > 0
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	q := c.Query("SELECT * FROM devices")
+
+	var page []*Twin
+	if err := q.Next(context.Background(), &page); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if sawHeader {
+		t.Fatalf("x-ms-max-item-count header present, want absent when WithPageSize wasn't called")
+	}
+}
@@ -0,0 +1,118 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amenzhinsky/golang-iothub/common"
+)
+
+// rewriteTransport redirects every request to addr regardless of the
+// request's original scheme/host, so a Client (which always builds
+// "https://<hub host>/..." URLs in request()) can be pointed at an
+// httptest.Server.
+type rewriteTransport struct {
+	addr string
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.addr
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestClient returns a Client that talks to srv instead of a real hub.
+func newTestClient(t *testing.T, srv *httptest.Server) *Client {
+	t.Helper()
+	c, err := NewClient(
+		WithCredentials(&common.Credentials{
+			HostName:            "unit-test.azure-devices.net",
+			SharedAccessKeyName: "service",
+			SharedAccessKey:     base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")),
+		}),
+		WithHTTPClient(&http.Client{
+			Transport: &rewriteTransport{addr: srv.Listener.Addr().String()},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return c
+}
+
+func TestPutDeviceIfMatch(t *testing.T) {
+	var gotMethod, gotIfMatch string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotIfMatch = r.Header.Get("If-Match")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"deviceId":"dev1","etag":"AAAA"}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+
+	if _, err := c.CreateDevice(context.Background(), &Device{DeviceID: "dev1"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	if gotMethod != http.MethodPut {
+		t.Fatalf("CreateDevice method = %q, want %q", gotMethod, http.MethodPut)
+	}
+	if gotIfMatch != "" {
+		t.Fatalf("CreateDevice sent If-Match = %q, want none", gotIfMatch)
+	}
+
+	if _, err := c.UpdateDevice(context.Background(), &Device{DeviceID: "dev1", ETag: "AAAA"}); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	if want := `"AAAA"`; gotIfMatch != want {
+		t.Fatalf("UpdateDevice If-Match = %q, want %q", gotIfMatch, want)
+	}
+
+	if _, err := c.UpdateDevice(context.Background(), &Device{DeviceID: "dev1", ETag: `"already-quoted"`}); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	if want := `"already-quoted"`; gotIfMatch != want {
+		t.Fatalf("UpdateDevice If-Match = %q, want %q (should not be double-quoted)", gotIfMatch, want)
+	}
+
+	if err := c.DeleteDevice(context.Background(), "dev1", ""); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	if gotMethod != http.MethodDelete {
+		t.Fatalf("DeleteDevice method = %q, want %q", gotMethod, http.MethodDelete)
+	}
+	if gotIfMatch != "*" {
+		t.Fatalf("DeleteDevice with no etag sent If-Match = %q, want %q", gotIfMatch, "*")
+	}
+}
+
+func TestListDevicesPath(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path + "?" + r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+
+	if _, err := c.ListDevices(context.Background(), 0); err != nil {
+		t.Fatalf("ListDevices(0) error = %v", err)
+	}
+	if want := "/devices?api-version=" + common.APIVersion; gotPath != want {
+		t.Fatalf("ListDevices(0) path = %q, want %q", gotPath, want)
+	}
+
+	if _, err := c.ListDevices(context.Background(), 50); err != nil {
+		t.Fatalf("ListDevices(50) error = %v", err)
+	}
+	if want := "/devices?top=50&api-version=" + common.APIVersion; gotPath != want {
+		t.Fatalf("ListDevices(50) path = %q, want %q", gotPath, want)
+	}
+}